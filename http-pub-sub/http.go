@@ -2,6 +2,9 @@ package httppubsub
 
 import (
 	"bufio"
+	"crypto/tls"
+	"encoding/json"
+	"errors"
 	"io"
 	"net/http"
 	"time"
@@ -9,6 +12,13 @@ import (
 	"webm-pub/http-pub-sub/pubsub"
 )
 
+const (
+	// Buffer size and initial RTT estimate given to each GET subscriber's
+	// pubsub.FlowControlledSub before any real drain samples have come in.
+	subscriberBufSize  = 100
+	subscriberRTTGuess = 2 * time.Second
+)
+
 // Defines an HTTPPubSub app. Usage is based on using an instance from
 // DefaultHTTPPubSubApp() and replacing individual functions in it with your own
 // for where you want to change behavior. This modified instance is then passed
@@ -39,7 +49,36 @@ type HTTPPubSubApp struct {
 	// Note that it is not necessary to close the request body here, that will
 	// be done by the package
 	OnClose func(interface{}, http.ResponseWriter, *http.Request) (int, string)
-} 
+
+	// Authenticates a publisher token and returns the channel names it's
+	// allowed to publish to. Only consulted by a webm-pub/tunnel.Server
+	// wired up against this app, not by HTTP POST/GET requests.
+	// DefaultHTTPPubSubApp sets it to a func which rejects every tunnel
+	// connection.
+	TunnelAuthz func(token string) (channels []string, err error)
+
+	// Authenticates an incoming publisher, typically via its TLS client
+	// certificate (the *tls.ConnectionState will be nil if the connection
+	// isn't using TLS at all). Called before OnOpen for every POST; if ok is
+	// false the request is rejected with 401 without OnOpen, GetNext, or any
+	// downstream webmkeeper ever being reached. Left nil by
+	// DefaultHTTPPubSubApp, which allows every publisher through
+	// unauthenticated.
+	AuthenticatePublisher func(*tls.ConnectionState, *http.Request) (identity string, ok bool)
+
+	// Same as AuthenticatePublisher, but consulted before OnOpen for every
+	// GET instead. Left nil by DefaultHTTPPubSubApp, so subscribers remain
+	// anonymous unless an app opts into this.
+	AuthenticateSubscriber func(*tls.ConnectionState, *http.Request) (identity string, ok bool)
+
+	// Called when a GET subscriber's pubsub.FlowControlledSub has flagged it
+	// as needing a resync: its queued backlog is being thrown away, and this
+	// should write a fresh bootstrap (header plus everything since the most
+	// recent random access point) directly to w in its place. Left nil by
+	// DefaultHTTPPubSubApp, in which case a subscriber that falls behind
+	// just keeps having messages dropped for it, as before.
+	Resync func(state interface{}, w io.Writer) error
+}
 
 // Returns an HTTPPubSubApp with all default behavior, which can then be chaned
 // on a function-by-function basis as needed
@@ -71,6 +110,10 @@ func DefaultHTTPPubSubApp() *HTTPPubSubApp {
 		) {
 			return 0, ""
 		},
+
+		TunnelAuthz: func(token string) ([]string, error) {
+			return nil, errors.New("tunnel publishing is not configured")
+		},
 	}
 }
 
@@ -91,6 +134,12 @@ func NewHTTPPubSub(app *HTTPPubSubApp) *HTTPPubSub {
 	}
 }
 
+// PMux returns the PubSubMux backing this HTTPPubSub, so that other
+// transports (e.g. WHEPHandler) can be wired into the same fan-out.
+func (h *HTTPPubSub) PMux() *pubsub.PubSubMux {
+	return h.pmux
+}
+
 func bail(w http.ResponseWriter, code int, ret string) bool {
 	if code == 0 {
 		return false
@@ -111,6 +160,22 @@ func (h *HTTPPubSub) doLast(
 // Implements ServeHTTP for the http.Handler interface
 func (h *HTTPPubSub) ServeHTTP(w http.ResponseWriter, req *http.Request) {
 	defer req.Body.Close()
+
+	if req.Method == "POST" && h.app.AuthenticatePublisher != nil {
+		if _, ok := h.app.AuthenticatePublisher(req.TLS, req); !ok {
+			w.WriteHeader(401)
+			w.Write([]byte("unauthorized"))
+			return
+		}
+	}
+	if req.Method == "GET" && h.app.AuthenticateSubscriber != nil {
+		if _, ok := h.app.AuthenticateSubscriber(req.TLS, req); !ok {
+			w.WriteHeader(401)
+			w.Write([]byte("unauthorized"))
+			return
+		}
+	}
+
 	channel, state, code, ret := h.app.OnOpen(w, req)
 	if bail(w, code, ret) {
 		return
@@ -141,19 +206,50 @@ func (h *HTTPPubSub) ServeHTTP(w http.ResponseWriter, req *http.Request) {
 
 	} else if req.Method == "GET" {
 
-		ch := make(chan interface{}, 100)
-		h.pmux.AddSubCh(channel, ch)
+		sub := pubsub.NewFlowControlledSub(subscriberBufSize, subscriberRTTGuess)
+		h.pmux.AddSubCh(channel, sub)
 		buf := bufio.NewWriter(w)
 
-		for bi := range ch {
-			b := bi.([]byte)
-			_, err := buf.Write(b)
-			if err != nil {
-				h.pmux.RemSubCh(channel, ch)
-				h.doLast(state, w, req)
-				return
+	subLoop:
+		for {
+			select {
+			case bi, ok := <-sub.Ch():
+				if !ok {
+					break subLoop
+				}
+				b := bi.([]byte)
+				n, err := buf.Write(b)
+				sub.OnWrite(n)
+				if err != nil {
+					h.pmux.RemSubCh(channel, sub)
+					h.doLast(state, w, req)
+					return
+				}
+				buf.Flush()
+
+			case <-sub.ResyncNeeded():
+				if h.app.Resync != nil {
+					// Throw away the stale backlog; Resync replaces it.
+				drain:
+					for {
+						select {
+						case _, ok := <-sub.Ch():
+							if !ok {
+								break subLoop
+							}
+						default:
+							break drain
+						}
+					}
+					if err := h.app.Resync(state, buf); err != nil {
+						h.pmux.RemSubCh(channel, sub)
+						h.doLast(state, w, req)
+						return
+					}
+					buf.Flush()
+				}
+				sub.Reset()
 			}
-			buf.Flush()
 		}
 	}
 
@@ -162,6 +258,43 @@ func (h *HTTPPubSub) ServeHTTP(w http.ResponseWriter, req *http.Request) {
 	h.doLast(state, w, req)
 }
 
+// ServeTrace streams newline-delimited JSON encoded pubsub.TraceEvents for
+// as long as the client stays connected, giving operators a live-debugging
+// view of channel activity instead of having to grep log.Printf output.
+// Events can be narrowed down with the "channel" query param (restrict to
+// one channel) and repeated "type" query params (restrict to those event
+// types); with neither given, every event is sent.
+func (h *HTTPPubSub) ServeTrace(w http.ResponseWriter, req *http.Request) {
+	filter := pubsub.TraceFilter{Channel: req.URL.Query().Get("channel")}
+	for _, t := range req.URL.Query()["type"] {
+		filter.Types = append(filter.Types, pubsub.TraceEventType(t))
+	}
+
+	doneCh := make(chan struct{})
+	defer close(doneCh)
+
+	ch := h.pmux.Trace(doneCh, filter)
+	enc := json.NewEncoder(w)
+	flusher, _ := w.(http.Flusher)
+
+	for {
+		select {
+		case ev, ok := <-ch:
+			if !ok {
+				return
+			}
+			if err := enc.Encode(ev); err != nil {
+				return
+			}
+			if flusher != nil {
+				flusher.Flush()
+			}
+		case <-req.Context().Done():
+			return
+		}
+	}
+}
+
 // Shortcut for calling:
 //	s := http.NewServeMux()
 //	s.Handle("/", httpPubSubInstance)
@@ -0,0 +1,168 @@
+package pubsub
+
+import (
+	"sync"
+	"time"
+)
+
+const (
+	// How many consecutive cluster boundaries a subscriber can spend with a
+	// backlog over 2*bdp before it's considered unrecoverable and in need of
+	// a resync, rather than just a momentarily slow drain.
+	maxOverBdpClusters = 3
+
+	// Weight given to each new sample when updating the EWMA drain rate.
+	rateEWMAWeight = 0.2
+
+	// bdp's floor before any real drain-rate sample has come in, so a fresh
+	// subscriber doesn't read as having zero capacity (and so look
+	// immediately overflowed) before OnWrite has ever run.
+	minBdpBytes = 64 * 1024
+)
+
+// FlowControlledSub wraps a subscriber channel with a BDP-style flow control
+// estimator, modeled on the one gRPC uses for HTTP/2 window sizing. Messages
+// are still dropped once its fixed-size buffer fills (see Enqueue), but it
+// also tracks how fast the subscriber is
+// actually draining messages and reports once the subscriber has fallen far
+// enough behind that its backlog should be thrown away and replaced with a
+// fresh keyframe checkpoint instead of continuing to drain a stale one.
+type FlowControlledSub struct {
+	ch     chan interface{}
+	resync chan struct{}
+
+	mu           sync.Mutex
+	rate         float64 // EWMA of bytes/sec drained
+	rttEstimate  time.Duration
+	queuedBytes  int
+	lastDrain    time.Time
+	overBdpCount int
+}
+
+// NewFlowControlledSub creates a FlowControlledSub with the given channel
+// buffer size and an initial round-trip-time estimate for the subscriber
+// (used to size the target buffer before any Write samples have come in).
+func NewFlowControlledSub(bufSize int, rttEstimate time.Duration) *FlowControlledSub {
+	return &FlowControlledSub{
+		ch:          make(chan interface{}, bufSize),
+		resync:      make(chan struct{}, 1),
+		rttEstimate: rttEstimate,
+		lastDrain:   time.Now(),
+	}
+}
+
+// Ch returns the underlying channel, suitable for passing to
+// PubSubMux.AddSubCh/RemSubCh like any other subscriber channel.
+func (f *FlowControlledSub) Ch() chan interface{} {
+	return f.ch
+}
+
+// ResyncNeeded returns a channel which receives a value once this
+// subscriber's backlog has been flagged (via OnClusterBoundary) as
+// unrecoverable. The caller should stop draining Ch's backlog, re-bootstrap
+// the subscriber from the latest random access point instead, and then call
+// Reset.
+func (f *FlowControlledSub) ResyncNeeded() <-chan struct{} {
+	return f.resync
+}
+
+// signalResync is called by pubSub.spin, never blocking the publish loop.
+func (f *FlowControlledSub) signalResync() {
+	select {
+	case f.resync <- struct{}{}:
+	default:
+	}
+}
+
+// Reset clears the accumulated backlog/overflow state. It should be called
+// after the caller has re-bootstrapped the subscriber in response to
+// ResyncNeeded, so a fresh window of sustained overflow is required before
+// it fires again.
+func (f *FlowControlledSub) Reset() {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+	f.queuedBytes = 0
+	f.overBdpCount = 0
+}
+
+// Enqueue attempts to hand b to the subscriber. accepted is false if the
+// channel's buffer was already full and the message was dropped. Enqueue
+// only tracks b against the subscriber's backlog; whether that backlog
+// counts as a sustained overflow needing a resync is entirely decided by
+// OnClusterBoundary's consecutive-boundary counter, not by any single
+// Enqueue call.
+func (f *FlowControlledSub) Enqueue(b []byte) (accepted bool) {
+	select {
+	case f.ch <- b:
+		accepted = true
+	default:
+	}
+
+	if accepted {
+		f.mu.Lock()
+		f.queuedBytes += len(b)
+		f.mu.Unlock()
+	}
+	return accepted
+}
+
+// OnClusterBoundary should be called by the publisher each time a new
+// Cluster begins. It's how FlowControlledSub counts "N cluster boundaries"
+// of sustained overflow rather than reacting to a single noisy spike in
+// queued bytes; once it's seen enough consecutive overflowing boundaries it
+// signals ResyncNeeded itself.
+func (f *FlowControlledSub) OnClusterBoundary() (needsResync bool) {
+	f.mu.Lock()
+	if f.queuedBytes > 2*f.bdp() {
+		f.overBdpCount++
+	} else {
+		f.overBdpCount = 0
+	}
+	needsResync = f.overBdpCount > maxOverBdpClusters
+	f.mu.Unlock()
+
+	if needsResync {
+		f.signalResync()
+	}
+	return needsResync
+}
+
+// OnWrite should be called by the subscriber's writer every time a Write of
+// n bytes to the underlying connection completes, so the drain rate
+// estimate and queued byte count can be kept up to date.
+func (f *FlowControlledSub) OnWrite(n int) {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+
+	now := time.Now()
+	elapsed := now.Sub(f.lastDrain).Seconds()
+	f.lastDrain = now
+
+	f.queuedBytes -= n
+	if f.queuedBytes < 0 {
+		f.queuedBytes = 0
+	}
+	if elapsed <= 0 {
+		return
+	}
+
+	sample := float64(n) / elapsed
+	if f.rate == 0 {
+		f.rate = sample
+	} else {
+		f.rate = rateEWMAWeight*sample + (1-rateEWMAWeight)*f.rate
+	}
+}
+
+// bdp returns the current bandwidth-delay-product estimate, in bytes. Until
+// a real drain sample has come in via OnWrite (rate == 0), it returns
+// minBdpBytes rather than 0, so a just-connected subscriber doesn't look
+// like it has zero capacity for the queued bytes it picks up before a
+// drain has even had a chance to happen.
+// Must be called with f.mu held.
+func (f *FlowControlledSub) bdp() int {
+	if f.rate == 0 {
+		return minBdpBytes
+	}
+	return int(f.rate * f.rttEstimate.Seconds())
+}
@@ -0,0 +1,70 @@
+package pubsub
+
+import (
+	"testing"
+	"time"
+)
+
+// TestEnqueueNoImmediateResync guards against Enqueue deciding resync on its
+// own: a single queued message on a freshly created subscriber (no OnWrite
+// samples yet) must not trip ResyncNeeded, since bdp() floors at
+// minBdpBytes until a real drain rate is known.
+func TestEnqueueNoImmediateResync(t *testing.T) {
+	f := NewFlowControlledSub(100, 2*time.Second)
+
+	if !f.Enqueue([]byte("hello")) {
+		t.Fatal("Enqueue should have accepted the message")
+	}
+
+	select {
+	case <-f.ResyncNeeded():
+		t.Fatal("ResyncNeeded fired after a single Enqueue on a fresh subscriber")
+	default:
+	}
+
+	if f.OnClusterBoundary() {
+		t.Fatal("OnClusterBoundary reported needsResync after a single small Enqueue")
+	}
+}
+
+// TestOnClusterBoundarySustainedOverflow checks that a resync is only
+// reported once the subscriber's backlog has stayed over 2*bdp for more
+// than maxOverBdpClusters consecutive boundaries, and that Reset clears the
+// backlog and the streak.
+func TestOnClusterBoundarySustainedOverflow(t *testing.T) {
+	f := NewFlowControlledSub(1000, 2*time.Second)
+
+	// Give it a real (small) drain rate so bdp() is based on measurement
+	// rather than the minBdpBytes floor.
+	f.OnWrite(10)
+	f.mu.Lock()
+	f.rate = 10 // bytes/sec
+	f.mu.Unlock()
+
+	big := make([]byte, 100)
+	if !f.Enqueue(big) {
+		t.Fatal("Enqueue should have accepted the message")
+	}
+
+	for i := 0; i < maxOverBdpClusters; i++ {
+		if f.OnClusterBoundary() {
+			t.Fatalf("OnClusterBoundary reported needsResync too early, on boundary %d", i+1)
+		}
+	}
+
+	if !f.OnClusterBoundary() {
+		t.Fatal("OnClusterBoundary did not report needsResync after sustained overflow")
+	}
+
+	select {
+	case <-f.ResyncNeeded():
+	default:
+		t.Fatal("ResyncNeeded did not fire after sustained overflow")
+	}
+
+	// Reset clears the backlog and the streak.
+	f.Reset()
+	if f.OnClusterBoundary() {
+		t.Fatal("OnClusterBoundary reported needsResync immediately after Reset")
+	}
+}
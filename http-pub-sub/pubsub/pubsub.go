@@ -23,22 +23,29 @@ import (
 )
 
 type pubSub struct {
-	addDst chan chan interface{}
-	remDst chan chan interface{}
-	src    chan interface{}
-	dsts   map[chan interface{}]struct{}
+	channel string
+	pmux    *PubSubMux
+
+	addDst     chan *FlowControlledSub
+	remDst     chan *FlowControlledSub
+	clusterDst chan struct{}
+	src        chan interface{}
+	dsts       map[chan interface{}]*FlowControlledSub
 
 	// These are only accessed/modified by the PubSubMux managing this pubSub
 
 	srcGotten bool
 }
 
-func newPubSub() *pubSub {
+func newPubSub(channel string, pmux *PubSubMux) *pubSub {
 	p := &pubSub{
-		addDst: make(chan chan interface{}),
-		remDst: make(chan chan interface{}),
-		src:    make(chan interface{}),
-		dsts:   map[chan interface{}]struct{}{},
+		channel:    channel,
+		pmux:       pmux,
+		addDst:     make(chan *FlowControlledSub),
+		remDst:     make(chan *FlowControlledSub),
+		clusterDst: make(chan struct{}),
+		src:        make(chan interface{}),
+		dsts:       map[chan interface{}]*FlowControlledSub{},
 	}
 	go p.spin()
 	return p
@@ -48,19 +55,35 @@ func (p *pubSub) spin() {
 outerloop:
 	for {
 		select {
-		case ch := <-p.addDst:
-			p.dsts[ch] = struct{}{}
-		case ch := <-p.remDst:
-			delete(p.dsts, ch)
+		case f := <-p.addDst:
+			p.dsts[f.Ch()] = f
+			p.pmux.EmitTrace(TraceEvent{
+				Type: TraceSubscriberAdd, Channel: p.channel, Time: time.Now(),
+			})
+		case f := <-p.remDst:
+			delete(p.dsts, f.Ch())
+			p.pmux.EmitTrace(TraceEvent{
+				Type: TraceSubscriberRemove, Channel: p.channel, Time: time.Now(),
+			})
+		case <-p.clusterDst:
+			for _, f := range p.dsts {
+				if f.OnClusterBoundary() {
+					p.pmux.EmitTrace(TraceEvent{
+						Type: TraceResyncNeeded, Channel: p.channel, Time: time.Now(),
+					})
+				}
+			}
 		case msg, ok := <-p.src:
 			if !ok {
 				break outerloop
 			}
-			for ch := range p.dsts {
-				select {
-				case ch <- msg:
-				default:
-					log.Printf("pubSub dropping message to channel %v", msg, ch)
+			b, _ := msg.([]byte)
+			for _, f := range p.dsts {
+				if !f.Enqueue(b) {
+					log.Printf("pubSub dropping message to channel %s", p.channel)
+					p.pmux.EmitTrace(TraceEvent{
+						Type: TraceMessageDropped, Channel: p.channel, Time: time.Now(),
+					})
 				}
 			}
 		}
@@ -78,11 +101,15 @@ type PubSubMux struct {
 	mux        map[string]*pubSub
 	muxLock    sync.Mutex
 	pubTimeout time.Duration
+
+	traceDsts map[chan TraceEvent]traceDst
+	traceLock sync.Mutex
 }
 
 func NewPubSubMux() *PubSubMux {
 	return &PubSubMux{
-		mux: map[string]*pubSub{},
+		mux:       map[string]*pubSub{},
+		traceDsts: map[chan TraceEvent]traceDst{},
 	}
 }
 
@@ -96,8 +123,9 @@ func (pmux *PubSubMux) GetPubCh(channel string) (chan<- interface{}, bool) {
 
 	p, ok := pmux.mux[channel]
 	if !ok {
-		p = newPubSub()
+		p = newPubSub(channel, pmux)
 		pmux.mux[channel] = p
+		pmux.EmitTrace(TraceEvent{Type: TraceChannelOpen, Channel: channel, Time: time.Now()})
 	}
 
 	srcGotten := p.srcGotten
@@ -119,30 +147,34 @@ func (pmux *PubSubMux) ClosePubCh(channel string) bool {
 
 	close(p.src)
 	delete(pmux.mux, channel)
+	pmux.EmitTrace(TraceEvent{Type: TraceChannelClose, Channel: channel, Time: time.Now()})
 	return true
 }
 
-// Subscribes the given subscription channel to the given channel. Creates the
+// Subscribes the given FlowControlledSub to the given channel, applying BDP
+// based flow control to every message published to it instead of the
+// fixed-buffer silent-drop sub.Ch() would get on its own. Creates the
 // routine for that channel if it didn't already exist
-func (pmux *PubSubMux) AddSubCh(channel string, ch chan interface{}) {
+func (pmux *PubSubMux) AddSubCh(channel string, f *FlowControlledSub) {
 	pmux.muxLock.Lock()
 	defer pmux.muxLock.Unlock()
 
 	p, ok := pmux.mux[channel]
 	if !ok {
-		p = newPubSub()
+		p = newPubSub(channel, pmux)
 		pmux.mux[channel] = p
+		pmux.EmitTrace(TraceEvent{Type: TraceChannelOpen, Channel: channel, Time: time.Now()})
 	}
 	select {
-	case p.addDst <- ch:
+	case p.addDst <- f:
 	case <-time.After(1 * time.Second):
 		log.Printf("pubSub timedout writing to addDst")
 	}
 }
 
-// Unsubsribes the given subscription channel from the given channel. Does NOT
+// Unsubsribes the given FlowControlledSub from the given channel. Does NOT
 // create the routine for that channel if it didn't already exist
-func (pmux *PubSubMux) RemSubCh(channel string, ch chan interface{}) {
+func (pmux *PubSubMux) RemSubCh(channel string, f *FlowControlledSub) {
 	pmux.muxLock.Lock()
 	defer pmux.muxLock.Unlock()
 
@@ -151,8 +183,26 @@ func (pmux *PubSubMux) RemSubCh(channel string, ch chan interface{}) {
 		return
 	}
 	select {
-	case p.remDst <- ch:
+	case p.remDst <- f:
 	case <-time.After(1 * time.Second):
 		log.Printf("pubSub timedout writing to remDst")
 	}
 }
+
+// ClusterBoundary should be called by the publisher each time a new Cluster
+// begins on channel, so every subscriber's FlowControlledSub can update its
+// over-BDP streak (see FlowControlledSub.OnClusterBoundary). Does nothing if
+// channel has neither a publisher nor any subscribers.
+func (pmux *PubSubMux) ClusterBoundary(channel string) {
+	pmux.muxLock.Lock()
+	p, ok := pmux.mux[channel]
+	pmux.muxLock.Unlock()
+	if !ok {
+		return
+	}
+	select {
+	case p.clusterDst <- struct{}{}:
+	case <-time.After(1 * time.Second):
+		log.Printf("pubSub timedout writing to clusterDst")
+	}
+}
@@ -0,0 +1,100 @@
+package pubsub
+
+import (
+	"time"
+)
+
+// TraceEventType identifies the kind of channel lifecycle action a TraceEvent
+// describes.
+type TraceEventType string
+
+const (
+	TraceChannelOpen       TraceEventType = "channel_open"
+	TraceChannelClose      TraceEventType = "channel_close"
+	TraceSubscriberAdd     TraceEventType = "subscriber_add"
+	TraceSubscriberRemove  TraceEventType = "subscriber_remove"
+	TraceMessageDropped    TraceEventType = "message_dropped"
+	TraceResyncNeeded      TraceEventType = "resync_needed"
+	TraceClusterRead       TraceEventType = "cluster_read"
+	TraceRandomAccessPoint TraceEventType = "random_access_point"
+)
+
+// TraceEvent is a single structured event describing something that
+// happened to a channel managed by a PubSubMux.
+type TraceEvent struct {
+	Type    TraceEventType `json:"type"`
+	Channel string         `json:"channel"`
+	Time    time.Time      `json:"time"`
+	Bytes   int            `json:"bytes,omitempty"`
+}
+
+// TraceFilter restricts which events a Trace subscriber receives. The zero
+// value matches every event.
+type TraceFilter struct {
+	// If non-empty, only events for this channel are sent.
+	Channel string
+
+	// If non-empty, only events whose Type is in this set are sent.
+	Types []TraceEventType
+}
+
+func (f TraceFilter) matches(ev TraceEvent) bool {
+	if f.Channel != "" && f.Channel != ev.Channel {
+		return false
+	}
+	if len(f.Types) == 0 {
+		return true
+	}
+	for _, t := range f.Types {
+		if t == ev.Type {
+			return true
+		}
+	}
+	return false
+}
+
+type traceDst struct {
+	ch     chan TraceEvent
+	filter TraceFilter
+}
+
+// Trace returns a channel of TraceEvents matching filter, for live-debugging
+// purposes (see the /trace endpoint in httppubsub). Like spin()'s message
+// fan-out, sending to trace consumers is non-blocking: a slow consumer has
+// events dropped for it rather than slowing down the publisher. The
+// returned channel is closed once doneCh is closed.
+func (pmux *PubSubMux) Trace(doneCh <-chan struct{}, filter TraceFilter) <-chan TraceEvent {
+	ch := make(chan TraceEvent, 4000)
+
+	pmux.traceLock.Lock()
+	pmux.traceDsts[ch] = traceDst{ch: ch, filter: filter}
+	pmux.traceLock.Unlock()
+
+	go func() {
+		<-doneCh
+		pmux.traceLock.Lock()
+		delete(pmux.traceDsts, ch)
+		pmux.traceLock.Unlock()
+		close(ch)
+	}()
+
+	return ch
+}
+
+// EmitTrace sends ev to every attached Trace consumer whose filter matches
+// it. It's exported so that other packages driving a PubSubMux (e.g.
+// webmkeeper's per-cluster/random-access-point callbacks) can contribute
+// events to the same trace stream.
+func (pmux *PubSubMux) EmitTrace(ev TraceEvent) {
+	pmux.traceLock.Lock()
+	defer pmux.traceLock.Unlock()
+	for _, dst := range pmux.traceDsts {
+		if !dst.filter.matches(ev) {
+			continue
+		}
+		select {
+		case dst.ch <- ev:
+		default:
+		}
+	}
+}
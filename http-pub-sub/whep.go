@@ -0,0 +1,184 @@
+package httppubsub
+
+import (
+	"bytes"
+	"encoding/json"
+	"net/http"
+	"strings"
+	"time"
+
+	"github.com/pion/webrtc/v3"
+
+	"webm-pub/http-pub-sub/pubsub"
+	"webm-pub/webmkeeper"
+)
+
+const (
+	// Buffer size and initial RTT estimate given to each WHEP subscriber's
+	// pubsub.FlowControlledSub before any real drain samples have come in.
+	whepSubBufSize  = 100
+	whepSubRTTGuess = 200 * time.Millisecond
+)
+
+// Wraps a webrtc.DataChannel so it can be handed to WebmKeeper.Bootstrap,
+// which only knows how to write to an io.Writer.
+type dataChannelWriter struct {
+	dc *webrtc.DataChannel
+}
+
+func (w dataChannelWriter) Write(b []byte) (int, error) {
+	if err := w.dc.Send(b); err != nil {
+		return 0, err
+	}
+	return len(b), nil
+}
+
+// WHEPHandler negotiates WebRTC subscriptions for channels tracked by a
+// PubSubMux, giving viewers a sub-second-latency alternative to the chunked
+// HTTP GET transport in HTTPPubSub. It's meant to be mounted on a path
+// sibling to the regular stream route, e.g. POSTing an SDP offer to
+// /stream/<name>/whep.
+type WHEPHandler struct {
+	pmux      *pubsub.PubSubMux
+	getKeeper func(channel string) (*webmkeeper.WebmKeeper, bool)
+}
+
+// NewWHEPHandler returns a WHEPHandler which will subscribe to channels on
+// pmux. getKeeper is used to look up the WebmKeeper for a channel so its
+// current header/cluster data can be used to bootstrap new peers.
+func NewWHEPHandler(
+	pmux *pubsub.PubSubMux,
+	getKeeper func(channel string) (*webmkeeper.WebmKeeper, bool),
+) *WHEPHandler {
+	return &WHEPHandler{pmux: pmux, getKeeper: getKeeper}
+}
+
+// ServeHTTP expects a POST body containing a JSON encoded SDP offer, and
+// responds with a JSON encoded SDP answer, per the WHEP convention. The
+// channel name is taken from the request path with the trailing "/whep"
+// stripped off. The offer must itself propose the data channel the stream
+// is delivered over; see SubscribeWebRTC.
+func (h *WHEPHandler) ServeHTTP(w http.ResponseWriter, req *http.Request) {
+	channel := strings.TrimSuffix(req.URL.Path, "/whep")
+
+	keeper, ok := h.getKeeper(channel)
+	if !ok {
+		http.Error(w, "couldn't find stream "+channel, 404)
+		return
+	}
+
+	var offer webrtc.SessionDescription
+	if err := json.NewDecoder(req.Body).Decode(&offer); err != nil {
+		http.Error(w, err.Error(), 400)
+		return
+	}
+
+	answer, err := h.SubscribeWebRTC(channel, keeper, offer)
+	if err != nil {
+		http.Error(w, err.Error(), 500)
+		return
+	}
+
+	w.Header().Set("Content-Type", "application/json")
+	json.NewEncoder(w).Encode(answer)
+}
+
+// SubscribeWebRTC negotiates a new peer connection for the given offer. The
+// offer must itself propose the data channel the stream is delivered over
+// (i.e. the subscriber has to call RTCPeerConnection.createDataChannel
+// before creating its offer) — per RFC 3264 an answer can't add an m=
+// section the offer didn't already have, so this only ever answers an
+// offer that already includes one; it never calls CreateDataChannel
+// itself. Once that data channel is open, keeper.Bootstrap is used to send
+// the header and current cluster as the first message, and the channel is
+// then subscribed to pmux so that every subsequent published element is
+// forwarded to the peer as its own message.
+func (h *WHEPHandler) SubscribeWebRTC(
+	channel string, keeper *webmkeeper.WebmKeeper, offer webrtc.SessionDescription,
+) (webrtc.SessionDescription, error) {
+	pc, err := webrtc.NewPeerConnection(webrtc.Configuration{})
+	if err != nil {
+		return webrtc.SessionDescription{}, err
+	}
+
+	pc.OnDataChannel(func(dc *webrtc.DataChannel) {
+		h.subscribeDataChannel(channel, keeper, pc, dc)
+	})
+
+	if err := pc.SetRemoteDescription(offer); err != nil {
+		return webrtc.SessionDescription{}, err
+	}
+
+	answer, err := pc.CreateAnswer(nil)
+	if err != nil {
+		return webrtc.SessionDescription{}, err
+	}
+
+	gatherComplete := webrtc.GatheringCompletePromise(pc)
+	if err := pc.SetLocalDescription(answer); err != nil {
+		return webrtc.SessionDescription{}, err
+	}
+	<-gatherComplete
+
+	return *pc.LocalDescription(), nil
+}
+
+// subscribeDataChannel bootstraps and subscribes dc once it's open, exactly
+// as SubscribeWebRTC's doc comment describes. It's called once the
+// subscriber's own offered data channel arrives via pc.OnDataChannel.
+func (h *WHEPHandler) subscribeDataChannel(
+	channel string, keeper *webmkeeper.WebmKeeper, pc *webrtc.PeerConnection, dc *webrtc.DataChannel,
+) {
+	dc.OnOpen(func() {
+		dcw := dataChannelWriter{dc}
+		var boot bytes.Buffer
+		if err := keeper.Bootstrap(&boot); err != nil {
+			pc.Close()
+			return
+		}
+		if err := dc.Send(boot.Bytes()); err != nil {
+			pc.Close()
+			return
+		}
+
+		sub := pubsub.NewFlowControlledSub(whepSubBufSize, whepSubRTTGuess)
+		h.pmux.AddSubCh(channel, sub)
+
+		go func() {
+			defer h.pmux.RemSubCh(channel, sub)
+			for {
+				select {
+				case bi, ok := <-sub.Ch():
+					if !ok {
+						return
+					}
+					b := bi.([]byte)
+					if err := dc.Send(b); err != nil {
+						pc.Close()
+						return
+					}
+					sub.OnWrite(len(b))
+
+				case <-sub.ResyncNeeded():
+					// Throw away the stale backlog; Resync replaces it.
+				drain:
+					for {
+						select {
+						case _, ok := <-sub.Ch():
+							if !ok {
+								return
+							}
+						default:
+							break drain
+						}
+					}
+					if err := keeper.Resync(dcw); err != nil {
+						pc.Close()
+						return
+					}
+					sub.Reset()
+				}
+			}
+		}()
+	})
+}
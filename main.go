@@ -1,14 +1,33 @@
 package main
 
 import (
+	"crypto/tls"
+	"errors"
+	"io"
 	"log"
+	"net"
 	"net/http"
+	"net/url"
+	"os"
+	"path/filepath"
+	"strconv"
+	"strings"
 	"sync"
+	"time"
 
 	hps "webm-pub/http-pub-sub"
+	"webm-pub/http-pub-sub/pubsub"
+	"webm-pub/tlsauth"
+	"webm-pub/tunnel"
 	"webm-pub/webmkeeper"
 )
 
+// If this directory exists at startup, every channel's stream is also
+// recorded into it (see maybeRecord), enabling GET /recording/<channel> and
+// the ?replay= param on GET /stream/<channel>. If it doesn't exist, the
+// server behaves exactly as if recording didn't exist.
+const recordingsDir = "recordings"
+
 type connState struct {
 	isBcaster bool
 	channel   string
@@ -41,8 +60,136 @@ func remKeeper(channel string) {
 	delete(keepers, channel)
 }
 
+var recordings = map[string]*webmkeeper.Recording{}
+var recordingsLock sync.RWMutex
+
+func getRecording(channel string) (*webmkeeper.Recording, bool) {
+	recordingsLock.RLock()
+	defer recordingsLock.RUnlock()
+	rec, ok := recordings[channel]
+	return rec, ok
+}
+
+// recordingBase returns the path prefix (without extension) for a new
+// recording session on channel. The session timestamp keeps it from
+// colliding with (and silently discarding) an earlier session's files for
+// the same channel; see loadRecordings for how those earlier sessions are
+// found again.
+func recordingBase(channel string) string {
+	ts := strconv.FormatInt(time.Now().Unix(), 10)
+	return filepath.Join(recordingsDir, url.PathEscape(channel)+"."+ts)
+}
+
+// parseRecordingName extracts the channel name and session timestamp back
+// out of a recording index path built by recordingBase.
+func parseRecordingName(indexPath string) (channel string, ts int64, err error) {
+	name := strings.TrimSuffix(filepath.Base(indexPath), ".index")
+	dot := strings.LastIndex(name, ".")
+	if dot < 0 {
+		return "", 0, errors.New("malformed recording filename")
+	}
+	if ts, err = strconv.ParseInt(name[dot+1:], 10, 64); err != nil {
+		return "", 0, err
+	}
+	channel, err = url.PathUnescape(name[:dot])
+	return channel, ts, err
+}
+
+// loadRecordings populates the recordings map from any recording sessions
+// already present in recordingsDir, so a channel recorded before a server
+// restart keeps serving GET /recording/<channel> and ?replay= immediately,
+// without waiting for its broadcaster to reconnect. If a channel has more
+// than one session on disk, only the most recent is loaded.
+func loadRecordings() {
+	matches, err := filepath.Glob(filepath.Join(recordingsDir, "*.index"))
+	if err != nil {
+		log.Printf("scanning %s for recordings: %s", recordingsDir, err)
+		return
+	}
+
+	latest := map[string]int64{}
+	for _, indexPath := range matches {
+		channel, ts, err := parseRecordingName(indexPath)
+		if err != nil {
+			log.Printf("skipping %s: %s", indexPath, err)
+			continue
+		}
+		if ts > latest[channel] {
+			latest[channel] = ts
+		}
+	}
+
+	recordingsLock.Lock()
+	defer recordingsLock.Unlock()
+	for channel, ts := range latest {
+		base := filepath.Join(recordingsDir, url.PathEscape(channel)+"."+strconv.FormatInt(ts, 10))
+		rec, err := webmkeeper.LoadRecording(base+".segment", base+".index")
+		if err != nil {
+			log.Printf("%s: loading recording: %s", channel, err)
+			continue
+		}
+		recordings[channel] = rec
+		log.Printf("%s: loaded recording from %s", channel, base)
+	}
+}
+
+// If recordingsDir exists, opens a Recording for channel under it and
+// attaches it to k, so its stream is persisted for GET /recording/<channel>
+// and GET /stream/<channel>?replay=. Recordings outlive the keeper that
+// started them, so they stay servable after the broadcaster disconnects.
+func maybeRecord(channel string, k *webmkeeper.WebmKeeper) {
+	if st, err := os.Stat(recordingsDir); err != nil || !st.IsDir() {
+		return
+	}
+
+	base := recordingBase(channel)
+	rec, err := webmkeeper.OpenRecording(base+".segment", base+".index")
+	if err != nil {
+		log.Printf("%s: opening recording: %s", channel, err)
+		return
+	}
+	if err := k.Record(rec); err != nil {
+		log.Printf("%s: starting recording: %s", channel, err)
+		return
+	}
+
+	recordingsLock.Lock()
+	recordings[channel] = rec
+	recordingsLock.Unlock()
+}
+
+// writeReplay writes the last dur of rec (header plus Clusters) to w, for
+// the ?replay= param on GET /stream/<channel>: the subscriber gets caught
+// up on recent history before being switched over to the live pubsub feed
+// by HTTPPubSub's usual GET handling. Note this can duplicate a small
+// amount of the tail, since Bootstrap (called right after) resends
+// everything since the keeper's own last random access point too.
+func writeReplay(w io.Writer, rec *webmkeeper.Recording, dur time.Duration) {
+	last, ok := rec.LastTimecode()
+	if !ok {
+		return
+	}
+	from := last - dur
+	if from < 0 {
+		from = 0
+	}
+
+	start, _, found := rec.Range(from, 0, false)
+	if !found {
+		return
+	}
+	if err := rec.WriteRange(w, start, -1); err != nil {
+		log.Printf("writing replay: %s", err)
+	}
+}
+
 func main() {
+	if st, err := os.Stat(recordingsDir); err == nil && st.IsDir() {
+		loadRecordings()
+	}
+
 	app := hps.DefaultHTTPPubSubApp()
+	var h *hps.HTTPPubSub
 
 	app.OnOpen =
 		func(w http.ResponseWriter, req *http.Request) (string, interface{}, int, string) {
@@ -58,16 +205,38 @@ func main() {
 					log.Printf("%s has error on open: %s", channel, err)
 					return channel, s, 400, err.Error()
 				}
+				k.OnCluster = func(bytes int) {
+					h.PMux().EmitTrace(pubsub.TraceEvent{
+						Type: pubsub.TraceClusterRead, Channel: channel, Bytes: bytes,
+					})
+					h.PMux().ClusterBoundary(channel)
+				}
+				k.OnRandomAccessPoint = func() {
+					h.PMux().EmitTrace(pubsub.TraceEvent{
+						Type: pubsub.TraceRandomAccessPoint, Channel: channel,
+					})
+				}
 				s.keeper = k
 
 				if !addKeeper(channel, k) {
 					return channel, s, 400, "has a writer already"
 				}
+				maybeRecord(channel, k)
 			} else {
 				k, ok := getKeeper(channel)
 				if !ok {
 					return channel, s, 404, "couldn't find stream "+channel
 				}
+				s.keeper = k
+
+				if replay := req.URL.Query().Get("replay"); replay != "" {
+					if dur, err := time.ParseDuration(replay); err != nil {
+						log.Printf("%s: bad replay param %q: %s", channel, replay, err)
+					} else if rec, ok := getRecording(channel); ok {
+						writeReplay(w, rec, dur)
+					}
+				}
+
 				k.Bootstrap(w)
 			}
 
@@ -86,6 +255,11 @@ func main() {
 			return b, 0, ""
 		}
 
+	app.Resync =
+		func(s interface{}, w io.Writer) error {
+			return s.(connState).keeper.Resync(w)
+		}
+
 	app.OnClose =
 		func(s interface{}, w http.ResponseWriter, req *http.Request) (int, string) {
 			channel := s.(connState).channel
@@ -97,10 +271,142 @@ func main() {
 		}
 
 	addr := ":8090"
+	srv := &http.Server{Addr: addr}
+
+	if roots, err := tlsauth.LoadRootCAs("publisher-roots.pem"); err != nil {
+		log.Printf("mTLS publisher auth disabled: %s", err)
+	} else {
+		app.AuthenticatePublisher = func(cs *tls.ConnectionState, req *http.Request) (string, bool) {
+			identity, ok := tlsauth.Identity(cs, roots)
+			if !ok {
+				return "", false
+			}
+			return identity, tlsauth.AllowedChannel(identity, req.URL.Path)
+		}
+		srv.TLSConfig = &tls.Config{
+			ClientCAs:  roots,
+			ClientAuth: tls.VerifyClientCertIfGiven,
+		}
+	}
+
+	h = hps.NewHTTPPubSub(app)
+	whep := hps.NewWHEPHandler(h.PMux(), getKeeper)
+
+	http.HandleFunc("/stream/", func(w http.ResponseWriter, req *http.Request) {
+		if req.Method == "POST" && strings.HasSuffix(req.URL.Path, "/whep") {
+			whep.ServeHTTP(w, req)
+			return
+		}
+		h.ServeHTTP(w, req)
+	})
+	http.HandleFunc("/trace", h.ServeTrace)
+	http.HandleFunc("/recording/", serveRecording)
 
-	h := hps.NewHTTPPubSub(app)
-	http.Handle("/stream/", h)
+	tunnelAddr := ":8091"
+	tunnelSrv := &tunnel.Server{
+		Authz:   app.TunnelAuthz,
+		Publish: publishVirtualStream(h),
+	}
+	go func() {
+		l, err := net.Listen("tcp", tunnelAddr)
+		if err != nil {
+			log.Fatal(err)
+		}
+		log.Printf("Listening for tunnels on %s", tunnelAddr)
+		log.Fatal(tunnelSrv.Serve(l))
+	}()
 
 	log.Printf("Listening on %s", addr)
-	log.Fatal(http.ListenAndServe(addr, nil))
+	if srv.TLSConfig != nil {
+		log.Fatal(srv.ListenAndServeTLS("server.crt", "server.key"))
+	} else {
+		log.Fatal(srv.ListenAndServe())
+	}
+}
+
+// Serves GET /recording/<channel>?from=<duration>&to=<duration> as a valid
+// standalone webm: the recording's header plus every Cluster from the
+// nearest random access point at or before from, up to and including the
+// last Cluster that starts at or before to. from and to are
+// durations (e.g. "90s") relative to when the recording began; to may be
+// omitted to mean "through the most recent Cluster".
+func serveRecording(w http.ResponseWriter, req *http.Request) {
+	channel := strings.TrimPrefix(req.URL.Path, "/recording")
+
+	rec, ok := getRecording(channel)
+	if !ok {
+		http.Error(w, "no recording for "+channel, 404)
+		return
+	}
+
+	from, err := time.ParseDuration(req.URL.Query().Get("from"))
+	if err != nil {
+		http.Error(w, "bad from param: "+err.Error(), 400)
+		return
+	}
+
+	var to time.Duration
+	hasTo := req.URL.Query().Get("to") != ""
+	if hasTo {
+		if to, err = time.ParseDuration(req.URL.Query().Get("to")); err != nil {
+			http.Error(w, "bad to param: "+err.Error(), 400)
+			return
+		}
+	}
+
+	start, end, found := rec.Range(from, to, hasTo)
+	if !found {
+		http.Error(w, "no recorded data at or before "+req.URL.Query().Get("from"), 404)
+		return
+	}
+
+	w.Header().Set("Content-Type", "video/webm")
+	if err := rec.WriteRange(w, start, end); err != nil {
+		log.Printf("%s: serving recording: %s", channel, err)
+	}
+}
+
+// Returns a tunnel.PublishFunc which feeds a virtual stream through
+// webmkeeper.New and publishes its elements on h's PubSubMux, exactly as
+// the POST branch of app.OnOpen/app.GetNext does for a real HTTP body.
+func publishVirtualStream(h *hps.HTTPPubSub) tunnel.PublishFunc {
+	return func(channel string, r io.Reader) {
+		k, err := webmkeeper.New(r)
+		if err != nil {
+			log.Printf("tunnel stream %s has error on open: %s", channel, err)
+			return
+		}
+		k.OnCluster = func(bytes int) {
+			h.PMux().EmitTrace(pubsub.TraceEvent{
+				Type: pubsub.TraceClusterRead, Channel: channel, Bytes: bytes,
+			})
+			h.PMux().ClusterBoundary(channel)
+		}
+		k.OnRandomAccessPoint = func() {
+			h.PMux().EmitTrace(pubsub.TraceEvent{
+				Type: pubsub.TraceRandomAccessPoint, Channel: channel,
+			})
+		}
+		if !addKeeper(channel, k) {
+			log.Printf("tunnel stream %s has a writer already", channel)
+			return
+		}
+		defer remKeeper(channel)
+		maybeRecord(channel, k)
+
+		pubCh, _ := h.PMux().GetPubCh(channel)
+		defer h.PMux().ClosePubCh(channel)
+
+		for {
+			b, err := k.Next()
+			if err != nil {
+				log.Printf("reading from tunnel stream %s: %s", channel, err)
+				return
+			}
+			select {
+			case pubCh <- b:
+			case <-time.After(5 * time.Second):
+			}
+		}
+	}
 }
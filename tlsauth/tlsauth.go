@@ -0,0 +1,70 @@
+// Helpers for authenticating publishers via mTLS: a PEM bundle of root CAs
+// (one cert per broadcaster org) is used to verify an incoming client
+// certificate's chain, and the cert's CN is then pinned as the channel-name
+// prefix that connection is allowed to use.
+package tlsauth
+
+import (
+	"crypto/tls"
+	"crypto/x509"
+	"errors"
+	"io/ioutil"
+	"strings"
+)
+
+// LoadRootCAs reads a PEM bundle from path (one cert per broadcaster org)
+// into a CertPool suitable for tls.Config.ClientCAs.
+func LoadRootCAs(path string) (*x509.CertPool, error) {
+	pemBytes, err := ioutil.ReadFile(path)
+	if err != nil {
+		return nil, err
+	}
+
+	pool := x509.NewCertPool()
+	if !pool.AppendCertsFromPEM(pemBytes) {
+		return nil, errors.New("tlsauth: no certificates found in " + path)
+	}
+	return pool, nil
+}
+
+// Identity verifies the leaf client certificate in cs against roots, using
+// any other certificates cs presented as intermediates, then returns the
+// leaf's CN as the publisher's identity. ok is false if cs has no client
+// certificate, or its chain doesn't verify against roots.
+func Identity(cs *tls.ConnectionState, roots *x509.CertPool) (identity string, ok bool) {
+	if cs == nil || len(cs.PeerCertificates) == 0 {
+		return "", false
+	}
+	leaf := cs.PeerCertificates[0]
+
+	intermediates := x509.NewCertPool()
+	for _, c := range cs.PeerCertificates[1:] {
+		intermediates.AddCert(c)
+	}
+
+	if _, err := leaf.Verify(x509.VerifyOptions{
+		Roots:         roots,
+		Intermediates: intermediates,
+		KeyUsages:     []x509.ExtKeyUsage{x509.ExtKeyUsageClientAuth},
+	}); err != nil {
+		return "", false
+	}
+	if leaf.Subject.CommonName == "" {
+		return "", false
+	}
+
+	return leaf.Subject.CommonName, true
+}
+
+// AllowedChannel reports whether identity (as returned by Identity) is
+// allowed to publish to channel, which is true only if channel is rooted at
+// the "/stream/<identity>/" prefix, e.g. identity "acme-corp" allows channel
+// "/stream/acme-corp/live1" but not "/stream/acme-corporate/live1" or
+// "/unrelated/acme-corp/live1".
+func AllowedChannel(identity, channel string) bool {
+	if identity == "" {
+		return false
+	}
+	prefix := "/stream/" + identity + "/"
+	return strings.HasPrefix(channel, prefix)
+}
@@ -0,0 +1,262 @@
+// Lets a remote webmkeeper process which sits behind NAT or a firewall, and
+// so can't accept an inbound POST /stream/<name>, dial out to this server
+// over a single long-lived connection instead. The server demultiplexes
+// that connection's length-prefixed frames back into per-channel virtual
+// publish streams, each fed to webmkeeper.New exactly as an HTTP POST body
+// would be. This is the same basic pattern as the telebit multiplexer: one
+// authenticated outbound connection standing in for any number of inbound
+// ones.
+package tunnel
+
+import (
+	"bufio"
+	"encoding/binary"
+	"errors"
+	"io"
+	"log"
+	"net"
+	"strings"
+	"sync"
+)
+
+const (
+	maxChannelLen = 1 << 8
+	maxPayloadLen = 1 << 20
+)
+
+// Frame is a single {channel, payload} tuple as sent over a tunnel
+// connection: a 2-byte channel name length, the channel name, a 4-byte
+// payload length, then the payload itself.
+type Frame struct {
+	Channel string
+	Payload []byte
+}
+
+// WriteFrame writes a Frame for the given channel and payload to w. It's
+// used by the client side of a tunnel (the remote webmkeeper process) to
+// push data to the server.
+func WriteFrame(w io.Writer, channel string, payload []byte) error {
+	if len(channel) > maxChannelLen {
+		return errors.New("tunnel: channel name too long")
+	}
+	if err := binary.Write(w, binary.BigEndian, uint16(len(channel))); err != nil {
+		return err
+	}
+	if _, err := io.WriteString(w, channel); err != nil {
+		return err
+	}
+	if err := binary.Write(w, binary.BigEndian, uint32(len(payload))); err != nil {
+		return err
+	}
+	_, err := w.Write(payload)
+	return err
+}
+
+func readFrame(r io.Reader) (Frame, error) {
+	var chanLen uint16
+	if err := binary.Read(r, binary.BigEndian, &chanLen); err != nil {
+		return Frame{}, err
+	}
+	chanBuf := make([]byte, chanLen)
+	if _, err := io.ReadFull(r, chanBuf); err != nil {
+		return Frame{}, err
+	}
+
+	var payloadLen uint32
+	if err := binary.Read(r, binary.BigEndian, &payloadLen); err != nil {
+		return Frame{}, err
+	}
+	if payloadLen > maxPayloadLen {
+		return Frame{}, errors.New("tunnel: payload too large")
+	}
+	payload := make([]byte, payloadLen)
+	if _, err := io.ReadFull(r, payload); err != nil {
+		return Frame{}, err
+	}
+
+	return Frame{Channel: string(chanBuf), Payload: payload}, nil
+}
+
+// virtualStream implements io.Reader for a single channel's worth of frame
+// payloads pulled off a tunnel connection, so it can be handed to
+// webmkeeper.New exactly as an http.Request.Body would be.
+type virtualStream struct {
+	ch     chan []byte
+	buf    []byte
+	closed chan struct{}
+}
+
+func newVirtualStream() *virtualStream {
+	return &virtualStream{
+		ch:     make(chan []byte, 16),
+		closed: make(chan struct{}),
+	}
+}
+
+func (vs *virtualStream) push(b []byte) {
+	select {
+	case vs.ch <- b:
+	case <-vs.closed:
+	}
+}
+
+func (vs *virtualStream) Read(p []byte) (int, error) {
+	for len(vs.buf) == 0 {
+		select {
+		case b, ok := <-vs.ch:
+			if !ok {
+				return 0, io.EOF
+			}
+			vs.buf = b
+		case <-vs.closed:
+			return 0, io.EOF
+		}
+	}
+	n := copy(p, vs.buf)
+	vs.buf = vs.buf[n:]
+	return n, nil
+}
+
+func (vs *virtualStream) close() {
+	select {
+	case <-vs.closed:
+	default:
+		close(vs.closed)
+	}
+}
+
+// PublishFunc is called once for each new virtual stream seen on a tunnel
+// connection, after its channel name has passed the connection's
+// authorization whitelist. It's expected to behave like the POST branch of
+// HTTPPubSubApp.OnOpen: read r with webmkeeper.New and publish the elements
+// it returns, returning once r is exhausted or errors.
+type PublishFunc func(channel string, r io.Reader)
+
+// Tunnel demultiplexes the frames on a single connection into per-channel
+// virtual streams, handing each new one to a PublishFunc.
+type Tunnel struct {
+	r        io.Reader
+	channels map[string]bool
+	publish  PublishFunc
+
+	mu      sync.Mutex
+	streams map[string]*virtualStream
+}
+
+// New returns a Tunnel which reads frames from r, only accepting ones whose
+// channel is in channels, and handing each new channel's virtualStream to
+// publish.
+func New(r io.Reader, channels []string, publish PublishFunc) *Tunnel {
+	allowed := make(map[string]bool, len(channels))
+	for _, c := range channels {
+		allowed[c] = true
+	}
+	return &Tunnel{
+		r:        r,
+		channels: allowed,
+		publish:  publish,
+		streams:  map[string]*virtualStream{},
+	}
+}
+
+// Serve reads frames until it hits an error (including io.EOF), demuxing
+// them into virtual streams as it goes. It blocks, so should be run in its
+// own goroutine per connection. Once Serve returns, every virtualStream it
+// created is closed, causing the corresponding PublishFunc calls to see
+// io.EOF from their Reads.
+func (t *Tunnel) Serve() error {
+	for {
+		f, err := readFrame(t.r)
+		if err != nil {
+			t.closeAll()
+			return err
+		}
+		if !t.channels[f.Channel] {
+			continue
+		}
+
+		t.mu.Lock()
+		vs, ok := t.streams[f.Channel]
+		if !ok {
+			vs = newVirtualStream()
+			t.streams[f.Channel] = vs
+			go func(channel string, vs *virtualStream) {
+				t.publish(channel, vs)
+				t.removeStream(channel, vs)
+			}(f.Channel, vs)
+		}
+		t.mu.Unlock()
+
+		vs.push(f.Payload)
+	}
+}
+
+// removeStream drops vs from t.streams once its PublishFunc has returned,
+// and closes it so that a frame which raced in for the same channel just
+// beforehand doesn't leave push() blocked forever on a consumer that's
+// gone. If a new virtualStream has already taken channel's place in
+// t.streams, it's left alone.
+func (t *Tunnel) removeStream(channel string, vs *virtualStream) {
+	t.mu.Lock()
+	if t.streams[channel] == vs {
+		delete(t.streams, channel)
+	}
+	t.mu.Unlock()
+	vs.close()
+}
+
+func (t *Tunnel) closeAll() {
+	t.mu.Lock()
+	defer t.mu.Unlock()
+	for _, vs := range t.streams {
+		vs.close()
+	}
+}
+
+// Server accepts long-lived tunnel connections from remote broadcasters and
+// demultiplexes each one's virtual publish streams.
+type Server struct {
+	// Authenticates a connection's token (read as a single newline
+	// terminated line before any frames) and returns the channel names it's
+	// allowed to publish to.
+	Authz func(token string) (channels []string, err error)
+
+	// Called for each virtual stream that passes Authz's whitelist. See
+	// PublishFunc.
+	Publish PublishFunc
+}
+
+// Serve accepts connections from l until it errors, handling each one in
+// its own goroutine.
+func (s *Server) Serve(l net.Listener) error {
+	for {
+		conn, err := l.Accept()
+		if err != nil {
+			return err
+		}
+		go s.handle(conn)
+	}
+}
+
+func (s *Server) handle(conn net.Conn) {
+	defer conn.Close()
+
+	br := bufio.NewReader(conn)
+	token, err := br.ReadString('\n')
+	if err != nil {
+		log.Printf("tunnel: reading auth token: %s", err)
+		return
+	}
+	token = strings.TrimSuffix(token, "\n")
+
+	channels, err := s.Authz(token)
+	if err != nil {
+		log.Printf("tunnel: rejecting connection: %s", err)
+		return
+	}
+
+	t := New(br, channels, s.Publish)
+	if err := t.Serve(); err != nil {
+		log.Printf("tunnel: connection closed: %s", err)
+	}
+}
@@ -0,0 +1,296 @@
+package webmkeeper
+
+import (
+	"encoding/binary"
+	"errors"
+	"io"
+	"io/ioutil"
+	"os"
+	"sort"
+	"sync"
+	"time"
+)
+
+// ClusterEntry records where a single Cluster lives within a recording's
+// segment file, how long after the recording started it arrived, and
+// whether it reached a full random access point (keyframes for every
+// track) before the next Cluster began. The index is appended to in
+// increasing FileOffset order, which is what lets Recording.Range use
+// sort.Search instead of a linear scan.
+type ClusterEntry struct {
+	FileOffset int64
+	Timecode   time.Duration
+	IsKeyframe bool
+}
+
+const clusterEntrySize = 8 + 8 + 1 // FileOffset + Timecode + IsKeyframe
+
+// Recording is the on-disk state for a WebmKeeper that's been told (via
+// WebmKeeper.Record) to keep a persistent copy of everything it reads: the
+// raw segment bytes (every element Next() has returned, starting from
+// whatever was buffered when recording began) plus an index of Cluster
+// boundaries, so that a time range can later be served back out of the
+// segment file without rescanning it from the start. The header is kept in
+// a small sidecar file (see headerPath) rather than inline in the segment,
+// so it can be recovered by LoadRecording without rescanning the segment
+// for where it ends.
+type Recording struct {
+	mu          sync.Mutex
+	segmentPath string
+	segment     *os.File // nil for a Recording returned by LoadRecording
+	index       *os.File // nil for a Recording returned by LoadRecording
+	headerFile  *os.File // nil for a Recording returned by LoadRecording
+	offset      int64
+	header      []byte
+	entries     []ClusterEntry
+
+	// Set by beginClusterEntry when a Cluster starts, and consumed by
+	// finalizeClusterEntry once that same Cluster's own blocks have been
+	// scanned and its keyframe status is known.
+	pendingValid    bool
+	pendingOffset   int64
+	pendingTimecode time.Duration
+}
+
+// headerPath returns the sidecar file a Recording keeps its header bytes
+// in, alongside its segment file.
+func headerPath(segmentPath string) string {
+	return segmentPath + ".header"
+}
+
+// OpenRecording creates (or truncates) segmentPath, indexPath, and their
+// header sidecar file, and returns a Recording ready to be passed to
+// WebmKeeper.Record. Use a path unique to this recording session (e.g.
+// including a timestamp) rather than reusing one from an earlier session
+// for the same channel, or that earlier recording's data will be lost; use
+// LoadRecording to read an earlier session's files back.
+func OpenRecording(segmentPath, indexPath string) (*Recording, error) {
+	segment, err := os.Create(segmentPath)
+	if err != nil {
+		return nil, err
+	}
+	index, err := os.Create(indexPath)
+	if err != nil {
+		segment.Close()
+		return nil, err
+	}
+	hdrFile, err := os.Create(headerPath(segmentPath))
+	if err != nil {
+		segment.Close()
+		index.Close()
+		return nil, err
+	}
+	return &Recording{
+		segmentPath: segmentPath,
+		segment:     segment,
+		index:       index,
+		headerFile:  hdrFile,
+	}, nil
+}
+
+// LoadRecording reconstructs a Recording's header and cluster index from an
+// earlier OpenRecording session's files, so a previously recorded stream
+// stays servable via GET /recording/<channel> (and as replay history)
+// across a server restart, without the broadcaster that produced it still
+// being connected. The returned Recording is read-only: passing it to
+// WebmKeeper.Record is not supported, since it has no way to know whether
+// the stream resuming here is even a continuation of the same encode.
+func LoadRecording(segmentPath, indexPath string) (*Recording, error) {
+	header, err := ioutil.ReadFile(headerPath(segmentPath))
+	if err != nil {
+		return nil, err
+	}
+
+	indexBytes, err := ioutil.ReadFile(indexPath)
+	if err != nil {
+		return nil, err
+	}
+	if len(indexBytes)%clusterEntrySize != 0 {
+		return nil, errors.New("webmkeeper: truncated recording index " + indexPath)
+	}
+	entries := make([]ClusterEntry, len(indexBytes)/clusterEntrySize)
+	for i := range entries {
+		buf := indexBytes[i*clusterEntrySize : (i+1)*clusterEntrySize]
+		entries[i] = ClusterEntry{
+			FileOffset: int64(binary.BigEndian.Uint64(buf[0:8])),
+			Timecode:   time.Duration(binary.BigEndian.Uint64(buf[8:16])),
+			IsKeyframe: buf[16] == 1,
+		}
+	}
+
+	st, err := os.Stat(segmentPath)
+	if err != nil {
+		return nil, err
+	}
+
+	return &Recording{
+		segmentPath: segmentPath,
+		header:      header,
+		entries:     entries,
+		offset:      st.Size(),
+	}, nil
+}
+
+// start writes the WebmKeeper's header to the header sidecar file and its
+// currently buffered body to the beginning of the segment file. It's only
+// ever called once, by WebmKeeper.Record.
+func (r *Recording) start(header, body []byte) error {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+
+	r.header = append([]byte(nil), header...)
+	if _, err := r.headerFile.Write(header); err != nil {
+		return err
+	}
+	n, err := r.segment.Write(body)
+	r.offset += int64(n)
+	return err
+}
+
+func (r *Recording) writeElem(b []byte) error {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+
+	n, err := r.segment.Write(b)
+	r.offset += int64(n)
+	return err
+}
+
+// beginClusterEntry records the offset and timecode of a Cluster that's
+// just starting, to be finalized via finalizeClusterEntry once that same
+// Cluster's own blocks have been scanned and its keyframe status is known.
+// Any previously pending entry must already have been finalized.
+func (r *Recording) beginClusterEntry(timecode time.Duration) {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+
+	r.pendingValid = true
+	r.pendingOffset = r.offset
+	r.pendingTimecode = timecode
+}
+
+// finalizeClusterEntry appends the ClusterEntry for the Cluster most
+// recently begun via beginClusterEntry, now that whether it reached a
+// keyframe is known. It's a no-op if no entry is pending, e.g. the first
+// Cluster of the recording, which is already buffered by New before
+// Record is ever called.
+func (r *Recording) finalizeClusterEntry(keyframe bool) error {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+
+	if !r.pendingValid {
+		return nil
+	}
+	r.pendingValid = false
+
+	entry := ClusterEntry{
+		FileOffset: r.pendingOffset,
+		Timecode:   r.pendingTimecode,
+		IsKeyframe: keyframe,
+	}
+	r.entries = append(r.entries, entry)
+
+	buf := make([]byte, clusterEntrySize)
+	binary.BigEndian.PutUint64(buf[0:8], uint64(entry.FileOffset))
+	binary.BigEndian.PutUint64(buf[8:16], uint64(entry.Timecode))
+	if entry.IsKeyframe {
+		buf[16] = 1
+	}
+	_, err := r.index.Write(buf)
+	return err
+}
+
+// Header returns the raw EBML/Segment header bytes this recording started
+// with. Prepending these to any byte range returned by Range produces a
+// valid standalone webm file.
+func (r *Recording) Header() []byte {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	return r.header
+}
+
+// LastTimecode returns the Timecode of the most recently completed
+// Cluster. found is false if no Cluster has completed yet.
+func (r *Recording) LastTimecode() (timecode time.Duration, found bool) {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	if len(r.entries) == 0 {
+		return 0, false
+	}
+	return r.entries[len(r.entries)-1].Timecode, true
+}
+
+// Range returns the byte range [start, end) within the segment file needed
+// to serve everything from `from` up to `to` (ignored if hasTo is false).
+// start is the offset of the last random-access-point Cluster at or before
+// `from`; found is false if no such Cluster exists yet. end is -1 if the
+// range should extend to the end of the file, either because hasTo is
+// false or because `to` is past every Cluster seen so far.
+func (r *Recording) Range(from, to time.Duration, hasTo bool) (start, end int64, found bool) {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+
+	i := sort.Search(len(r.entries), func(i int) bool {
+		return r.entries[i].Timecode > from
+	})
+
+	start = -1
+	for j := i - 1; j >= 0; j-- {
+		if r.entries[j].IsKeyframe {
+			start = r.entries[j].FileOffset
+			break
+		}
+	}
+	if start < 0 {
+		return 0, 0, false
+	}
+
+	end = -1
+	if hasTo {
+		j := sort.Search(len(r.entries), func(j int) bool {
+			return r.entries[j].Timecode > to
+		})
+		if j < len(r.entries) {
+			end = r.entries[j].FileOffset
+		}
+	}
+	return start, end, true
+}
+
+// Open returns a new *os.File for reading the underlying segment file,
+// independent of the handle being appended to, so that playback reads
+// don't race with the recording's writer.
+func (r *Recording) Open() (*os.File, error) {
+	r.mu.Lock()
+	path := r.segmentPath
+	r.mu.Unlock()
+	return os.Open(path)
+}
+
+// WriteRange writes this recording's header followed by the segment bytes
+// in [start, end) to w. end may be -1 to mean "through the end of the
+// file".
+func (r *Recording) WriteRange(w io.Writer, start, end int64) error {
+	f, err := r.Open()
+	if err != nil {
+		return err
+	}
+	defer f.Close()
+
+	if _, err := w.Write(r.Header()); err != nil {
+		return err
+	}
+	if _, err := f.Seek(start, io.SeekStart); err != nil {
+		return err
+	}
+
+	if end < 0 {
+		_, err = io.Copy(w, f)
+		return err
+	}
+	if end < start {
+		return errors.New("webmkeeper: recording range end before start")
+	}
+	_, err = io.CopyN(w, f, end-start)
+	return err
+}
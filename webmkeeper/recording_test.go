@@ -0,0 +1,94 @@
+package webmkeeper
+
+import (
+	"io/ioutil"
+	"os"
+	"testing"
+	"time"
+)
+
+// newTestRecording returns a Recording backed by temp files, along with a
+// cleanup func to remove them.
+func newTestRecording(t *testing.T) (*Recording, func()) {
+	t.Helper()
+
+	dir, err := ioutil.TempDir("", "webmkeeper-recording-test")
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	r, err := OpenRecording(dir+"/segment", dir+"/index")
+	if err != nil {
+		os.RemoveAll(dir)
+		t.Fatal(err)
+	}
+
+	return r, func() { os.RemoveAll(dir) }
+}
+
+// writeCluster simulates webmkeeper.handleRandomAccessPoint's "Cluster"
+// case finalizing the previous pending entry and beginning a new one, then
+// writes n bytes to the segment to advance r.offset the way writeElem
+// would for the cluster's own blocks.
+func writeCluster(t *testing.T, r *Recording, prevKeyframe bool, timecode time.Duration, n int) {
+	t.Helper()
+	if err := r.finalizeClusterEntry(prevKeyframe); err != nil {
+		t.Fatal(err)
+	}
+	r.beginClusterEntry(timecode)
+	if err := r.writeElem(make([]byte, n)); err != nil {
+		t.Fatal(err)
+	}
+}
+
+// TestClusterEntryPairing checks that each ClusterEntry's FileOffset is
+// paired with the keyframe status of the very same Cluster, not the one
+// before it.
+func TestClusterEntryPairing(t *testing.T) {
+	r, cleanup := newTestRecording(t)
+	defer cleanup()
+
+	// Cluster A: not a keyframe, starts at offset 0.
+	writeCluster(t, r, false, 0, 10)
+	// Cluster B: reaches a keyframe, starts at offset 10.
+	writeCluster(t, r, false /* A's keyframe status */, 1*time.Second, 20)
+	// Cluster C: not a keyframe, starts at offset 30. Finalizes B's entry,
+	// this time with B's own keyframe status (true).
+	writeCluster(t, r, true /* B's keyframe status */, 2*time.Second, 5)
+
+	if got := len(r.entries); got != 2 {
+		t.Fatalf("expected 2 finalized entries (A and B), got %d", got)
+	}
+
+	a, b := r.entries[0], r.entries[1]
+	if a.FileOffset != 0 || a.IsKeyframe {
+		t.Errorf("entry A = %+v, want FileOffset=0 IsKeyframe=false", a)
+	}
+	if b.FileOffset != 10 || !b.IsKeyframe {
+		t.Errorf("entry B = %+v, want FileOffset=10 IsKeyframe=true", b)
+	}
+}
+
+// TestRangeFindsOwnClusterKeyframe is a regression test for the bug where
+// Range's backward scan (over indices < i) could never see that the
+// Cluster containing `from` was itself the nearest keyframe, because its
+// entry was stored with the wrong Cluster's keyframe flag.
+func TestRangeFindsOwnClusterKeyframe(t *testing.T) {
+	r, cleanup := newTestRecording(t)
+	defer cleanup()
+
+	writeCluster(t, r, false, 0, 10)             // begins A
+	writeCluster(t, r, false, 1*time.Second, 20) // begins B, finalizes A (not a keyframe)
+	writeCluster(t, r, true, 2*time.Second, 5)   // begins C, finalizes B (a keyframe)
+	writeCluster(t, r, false, 3*time.Second, 15) // begins D, finalizes C (not a keyframe)
+
+	// `from` lands inside B's own window (B starts at t=1s); the nearest
+	// preceding keyframe Cluster is B itself, at offset 10.
+	start, _, found := r.Range(1500*time.Millisecond, 0, false)
+	if !found {
+		t.Fatal("Range did not find a start offset")
+	}
+	if start != 10 {
+		t.Errorf("Range start = %d, want 10 (B's own offset)", start)
+	}
+}
@@ -4,9 +4,12 @@ package webmkeeper
 
 import (
 	"bytes"
+	"errors"
 	"fmt"
 	"github.com/mediocregopher/ebmlstream/edtd"
 	"io"
+	"log"
+	"time"
 
 	"webm-pub/webm"
 )
@@ -46,6 +49,28 @@ type WebmKeeper struct {
 	lastCluster        int
 	trackBlockCount    [2]byte
 	trackBlockKeyframe [2]bool
+
+	// Optional hooks for observability, e.g. feeding a pubsub.PubSubMux's
+	// trace stream. Left nil, as they are by New, they're simply not called.
+
+	// Called with the byte size of each Cluster once it's been completely
+	// read.
+	OnCluster func(bytes int)
+
+	// Called whenever wk.body gets truncated back to the most recent
+	// random access point.
+	OnRandomAccessPoint func()
+
+	// Set by Record; if non-nil, every element is also appended to a
+	// persistent Recording, and every Cluster boundary is indexed.
+	rec *Recording
+
+	// Whether a random access point was reached somewhere in the Cluster
+	// currently being recorded, i.e. whether that Cluster should be
+	// considered a valid seek target once it's done.
+	recPendingKeyframe bool
+
+	recStarted time.Time
 }
 
 // Reads the ebml and Segment header portions of the webm stream so that they
@@ -91,6 +116,31 @@ func (wk *WebmKeeper) Bootstrap(w io.Writer) error {
 	return nil
 }
 
+// Re-sends just the header plus the data since the most recent random access
+// point to w. It's meant for a subscriber that a pubsub.FlowControlledSub has
+// flagged as needing a resync: the caller has already given up on draining
+// that subscriber's backlog, and this gets it caught back up to a valid
+// starting point instead of being dropped entirely.
+func (wk *WebmKeeper) Resync(w io.Writer) error {
+	return wk.Bootstrap(w)
+}
+
+// Record starts mirroring this WebmKeeper's output into rec: the header and
+// currently buffered body are written immediately, and every future Next()
+// element and Cluster boundary follows. It's an error to call Record more
+// than once on the same WebmKeeper.
+func (wk *WebmKeeper) Record(rec *Recording) error {
+	if wk.rec != nil {
+		return errors.New("webmkeeper: already recording")
+	}
+	if err := rec.start(wk.header.Bytes(), wk.body.Bytes()); err != nil {
+		return err
+	}
+	wk.rec = rec
+	wk.recStarted = time.Now()
+	return nil
+}
+
 // Returns the next piece of the stream available for writing to clients.
 func (wk *WebmKeeper) Next() ([]byte, error) {
 	el, err := next(wk.p)
@@ -108,6 +158,13 @@ func (wk *WebmKeeper) Next() ([]byte, error) {
 	copy(b, wk.elemBuf.Bytes())
 
 	wk.body.Write(b)
+
+	if wk.rec != nil {
+		if err := wk.rec.writeElem(b); err != nil {
+			log.Printf("webmkeeper: writing to recording: %s", err)
+		}
+	}
+
 	return b, nil
 }
 
@@ -117,6 +174,16 @@ func (wk *WebmKeeper) Next() ([]byte, error) {
 func (wk *WebmKeeper) handleRandomAccessPoint(el *edtd.Elem) error {
 	switch el.Name {
 	case "Cluster":
+		if wk.rec != nil {
+			if err := wk.rec.finalizeClusterEntry(wk.recPendingKeyframe); err != nil {
+				log.Printf("webmkeeper: writing recording index: %s", err)
+			}
+			wk.rec.beginClusterEntry(time.Since(wk.recStarted))
+			wk.recPendingKeyframe = false
+		}
+		if wk.OnCluster != nil {
+			wk.OnCluster(wk.body.Len() - wk.lastCluster)
+		}
 		wk.lastCluster = wk.body.Len()
 		wk.resetTracking()
 		return nil
@@ -147,6 +214,10 @@ func (wk *WebmKeeper) handleRandomAccessPoint(el *edtd.Elem) error {
 			wk.body.Reset()
 			wk.body.Write(b)
 			wk.lastCluster = 0
+			wk.recPendingKeyframe = true
+			if wk.OnRandomAccessPoint != nil {
+				wk.OnRandomAccessPoint()
+			}
 		}
 
 		return nil